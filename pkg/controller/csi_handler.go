@@ -0,0 +1,150 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+)
+
+// CSIConnection is the subset of the CSI Controller gRPC client that csiHandler needs,
+// narrowed so tests can substitute a fake instead of a live connection to the driver.
+type CSIConnection interface {
+	ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error)
+	ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error)
+}
+
+// csiHandler reconciles a single VolumeAttachment against the CSI driver named in its
+// Spec.Attacher.
+type csiHandler struct {
+	client          kubernetes.Interface
+	csiConnection   CSIConnection
+	csiDriverLister storagelisters.CSIDriverLister
+	pvLister        corelisters.PersistentVolumeLister
+	podLister       corelisters.PodLister
+	migration       MigrationConfig
+}
+
+// NewCSIHandler returns a csiHandler that attaches and detaches VolumeAttachments
+// through csiConnection, consulting csiDriverLister for each driver's CSIDriver object,
+// translating in-tree PersistentVolumes through migration as configured, and resolving
+// pod identity via pvLister/podLister for drivers with PodInfoOnMount set.
+func NewCSIHandler(client kubernetes.Interface, csiConnection CSIConnection, csiDriverLister storagelisters.CSIDriverLister, pvLister corelisters.PersistentVolumeLister, podLister corelisters.PodLister, migration MigrationConfig) *csiHandler {
+	return &csiHandler{
+		client:          client,
+		csiConnection:   csiConnection,
+		csiDriverLister: csiDriverLister,
+		pvLister:        pvLister,
+		podLister:       podLister,
+		migration:       migration,
+	}
+}
+
+// Attach reconciles va into the attached state. pvSpec is the PersistentVolumeSpec the
+// VolumeAttachment refers to, already resolved by the caller from either
+// Spec.Source.PersistentVolumeName or Spec.Source.InlineVolumeSpec; it may be an in-tree
+// volume source, which h.migration translates to its CSI equivalent before use.
+func (h *csiHandler) Attach(ctx context.Context, va *storage.VolumeAttachment, pvSpec *v1.PersistentVolumeSpec) (*storage.VolumeAttachment, error) {
+	if out, handled, err := SkipAttachIfNotRequired(h.client, va, h.csiDriverLister); handled || err != nil {
+		return out, err
+	}
+
+	ctx, volumeCapability, err := h.migration.GetVolumeCapabilities(ctx, pvSpec, nil)
+	if err != nil {
+		return va, err
+	}
+	ctx, volumeHandle, readOnly, err := h.migration.GetVolumeHandle(ctx, pvSpec)
+	if err != nil {
+		return va, err
+	}
+	_, attributes, err := h.migration.GetVolumeAttributes(ctx, pvSpec)
+	if err != nil {
+		return va, err
+	}
+	attributes, err = GetVolumeContextForVolumeAttachment(attributes, va, h.podInfoOnMount(va.Spec.Attacher), false, h.pvLister, h.podLister)
+	if err != nil {
+		return va, err
+	}
+
+	resp, err := h.csiConnection.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeHandle,
+		NodeId:           va.Spec.NodeName,
+		VolumeCapability: volumeCapability,
+		Readonly:         readOnly,
+		VolumeContext:    attributes,
+	})
+	if err != nil {
+		return va, err
+	}
+	return markAsAttached(h.client, va, resp.PublishContext)
+}
+
+// Detach reconciles va into the detached state, mirroring Attach.
+func (h *csiHandler) Detach(ctx context.Context, va *storage.VolumeAttachment, pvSpec *v1.PersistentVolumeSpec) (*storage.VolumeAttachment, error) {
+	if out, handled, err := SkipDetachIfNotRequired(h.client, va, h.csiDriverLister); handled || err != nil {
+		return out, err
+	}
+	if pvSpec == nil {
+		return va, fmt.Errorf("VolumeAttachment %q has no resolvable volume source", va.Name)
+	}
+
+	ctx, volumeHandle, _, err := h.migration.GetVolumeHandle(ctx, pvSpec)
+	if err != nil {
+		return va, err
+	}
+
+	if _, err := h.csiConnection.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeHandle,
+		NodeId:   va.Spec.NodeName,
+	}); err != nil {
+		return va, err
+	}
+	return markAsDetached(h.client, va)
+}
+
+// Update patches va from old to new, refusing and leaving va untouched if the change
+// would alter an immutable field of the VolumeAttachment or of the PersistentVolume it
+// refers to. oldPVSpec and newPVSpec are that PersistentVolume's spec before and after,
+// as UpdateVolumeAttachment expects; pass nil for both when va carries an inline volume
+// spec instead.
+func (h *csiHandler) Update(old, new *storage.VolumeAttachment, oldPVSpec, newPVSpec *v1.PersistentVolumeSpec) (*storage.VolumeAttachment, error) {
+	patch, err := UpdateVolumeAttachment(old, new, oldPVSpec, newPVSpec, h.migration)
+	if err != nil {
+		return old, err
+	}
+	return h.client.StorageV1().VolumeAttachments().Patch(context.TODO(), old.Name, types.MergePatchType, patch, metav1.PatchOptions{}, "")
+}
+
+// podInfoOnMount reports whether driver's CSIDriver object requests pod info in the
+// volume context. It defaults to false, like an unrecognized or lookup-failed driver,
+// since that's also what a driver registering no CSIDriver object at all means.
+func (h *csiHandler) podInfoOnMount(driver string) bool {
+	csiDriver, err := h.csiDriverLister.Get(driver)
+	if err != nil {
+		return false
+	}
+	return csiDriver.Spec.PodInfoOnMount != nil && *csiDriver.Spec.PodInfoOnMount
+}
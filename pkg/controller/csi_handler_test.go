@@ -0,0 +1,249 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeCSIConnection records whether each RPC was called, so tests can assert a skipped
+// attach/detach never reached the driver at all.
+type fakeCSIConnection struct {
+	publishCalled   bool
+	unpublishCalled bool
+	publishContext  map[string]string
+	lastPublishReq  *csi.ControllerPublishVolumeRequest
+}
+
+func (f *fakeCSIConnection) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	f.publishCalled = true
+	f.lastPublishReq = req
+	return &csi.ControllerPublishVolumeResponse{PublishContext: f.publishContext}, nil
+}
+
+func (f *fakeCSIConnection) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	f.unpublishCalled = true
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func csiPVSpec() *v1.PersistentVolumeSpec {
+	return &v1.PersistentVolumeSpec{
+		AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{
+				Driver:       "csi.example.com",
+				VolumeHandle: "vol-1",
+			},
+		},
+	}
+}
+
+func TestCSIHandlerAttach(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "csi.example.com", NodeName: "node-1"},
+	}
+	conn := &fakeCSIConnection{publishContext: map[string]string{"device": "/dev/foo"}}
+	handler := NewCSIHandler(fake.NewSimpleClientset(va), conn, newCSIDriverLister(), newPVLister(), newPodLister(), MigrationConfig{})
+
+	out, err := handler.Attach(context.Background(), va, csiPVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !conn.publishCalled {
+		t.Errorf("expected ControllerPublishVolume to be called")
+	}
+	if !out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked attached")
+	}
+	if out.Status.AttachmentMetadata["device"] != "/dev/foo" {
+		t.Errorf("expected publish context to become attachment metadata, got %+v", out.Status.AttachmentMetadata)
+	}
+}
+
+func TestCSIHandlerAttachSkipsRPCWhenAttachNotRequired(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "no-attach.example.com", NodeName: "node-1"},
+	}
+	lister := newCSIDriverLister(&storage.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-attach.example.com"},
+		Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+	})
+	conn := &fakeCSIConnection{}
+	handler := NewCSIHandler(fake.NewSimpleClientset(va), conn, lister, newPVLister(), newPodLister(), MigrationConfig{})
+
+	out, err := handler.Attach(context.Background(), va, csiPVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if conn.publishCalled {
+		t.Errorf("expected ControllerPublishVolume not to be called")
+	}
+	if !out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked attached without the RPC")
+	}
+}
+
+func TestCSIHandlerAttachTranslatesInTreeVolume(t *testing.T) {
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName, translatedPV: translatedCSIPV()})
+
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "pd.csi.storage.gke.io", NodeName: "node-1"},
+	}
+	conn := &fakeCSIConnection{}
+	migration := NewMigrationConfig(true, gcePDPluginName)
+	handler := NewCSIHandler(fake.NewSimpleClientset(va), conn, newCSIDriverLister(), newPVLister(), newPodLister(), migration)
+
+	out, err := handler.Attach(context.Background(), va, gceInTreePVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !conn.publishCalled {
+		t.Fatalf("expected ControllerPublishVolume to be called with the translated volume")
+	}
+	want := "projects/my-project/zones/us-central1-a/disks/my-disk"
+	if conn.lastPublishReq.VolumeId != want {
+		t.Errorf("expected translated VolumeHandle %q, got %q", want, conn.lastPublishReq.VolumeId)
+	}
+	if !out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked attached")
+	}
+}
+
+func TestCSIHandlerAttachIncludesPodInfoWhenRequested(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec:       v1.PersistentVolumeSpec{ClaimRef: &v1.ObjectReference{Namespace: "my-ns", Name: "my-pvc"}},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "my-ns"},
+		Spec: v1.PodSpec{
+			NodeName: "node-1",
+			Volumes: []v1.Volume{
+				{VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "my-pvc"}}},
+			},
+		},
+	}
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: "csi.example.com",
+			NodeName: "node-1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+		},
+	}
+	lister := newCSIDriverLister(&storage.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi.example.com"},
+		Spec:       storage.CSIDriverSpec{PodInfoOnMount: boolPtr(true)},
+	})
+	conn := &fakeCSIConnection{}
+	handler := NewCSIHandler(fake.NewSimpleClientset(va), conn, lister, newPVLister(pv), newPodLister(pod), MigrationConfig{})
+
+	if _, err := handler.Attach(context.Background(), va, csiPVSpec()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if conn.lastPublishReq.VolumeContext["csi.storage.k8s.io/pod.name"] != "my-pod" {
+		t.Errorf("expected pod info in the volume context, got %+v", conn.lastPublishReq.VolumeContext)
+	}
+}
+
+func TestCSIHandlerDetach(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1", Finalizers: []string{GetFinalizerName("csi.example.com")}},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "csi.example.com", NodeName: "node-1"},
+		Status:     storage.VolumeAttachmentStatus{Attached: true},
+	}
+	conn := &fakeCSIConnection{}
+	handler := NewCSIHandler(fake.NewSimpleClientset(va), conn, newCSIDriverLister(), newPVLister(), newPodLister(), MigrationConfig{})
+
+	out, err := handler.Detach(context.Background(), va, csiPVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !conn.unpublishCalled {
+		t.Errorf("expected ControllerUnpublishVolume to be called")
+	}
+	if out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked detached")
+	}
+}
+
+func TestCSIHandlerUpdate(t *testing.T) {
+	oldVA := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "csi.example.com", NodeName: "node-1"},
+	}
+	newVA := oldVA.DeepCopy()
+	newVA.Annotations = map[string]string{"foo": "bar"}
+	handler := NewCSIHandler(fake.NewSimpleClientset(oldVA), &fakeCSIConnection{}, newCSIDriverLister(), newPVLister(), newPodLister(), MigrationConfig{})
+
+	out, err := handler.Update(oldVA, newVA, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out.Annotations["foo"] != "bar" {
+		t.Errorf("expected the patch to be applied, got %+v", out.Annotations)
+	}
+}
+
+func TestCSIHandlerUpdateRejectsImmutableFieldChange(t *testing.T) {
+	oldVA := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "csi.example.com", NodeName: "node-1"},
+	}
+	newVA := oldVA.DeepCopy()
+	newVA.Spec.NodeName = "node-2"
+	handler := NewCSIHandler(fake.NewSimpleClientset(oldVA), &fakeCSIConnection{}, newCSIDriverLister(), newPVLister(), newPodLister(), MigrationConfig{})
+
+	if _, err := handler.Update(oldVA, newVA, nil, nil); err == nil {
+		t.Fatalf("expected an immutable field change to be rejected")
+	}
+}
+
+func TestCSIHandlerDetachSkipsRPCWhenAttachNotRequired(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1", Finalizers: []string{GetFinalizerName("no-attach.example.com")}},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "no-attach.example.com", NodeName: "node-1"},
+		Status:     storage.VolumeAttachmentStatus{Attached: true},
+	}
+	lister := newCSIDriverLister(&storage.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-attach.example.com"},
+		Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+	})
+	conn := &fakeCSIConnection{}
+	handler := NewCSIHandler(fake.NewSimpleClientset(va), conn, lister, newPVLister(), newPodLister(), MigrationConfig{})
+
+	out, err := handler.Detach(context.Background(), va, csiPVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if conn.unpublishCalled {
+		t.Errorf("expected ControllerUnpublishVolume not to be called")
+	}
+	if out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked detached without the RPC")
+	}
+}
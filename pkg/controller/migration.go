@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	csitrans "k8s.io/csi-translation-lib"
+)
+
+// additionalInfoKey is the unexported context key type MarkContextAsMigrated stores
+// AdditionalInfo under, following the convention that context keys should not be
+// exported so no other package can collide with it.
+type additionalInfoKey struct{}
+
+// AdditionalInfo carries metadata about a request that RPC call sites need but that
+// doesn't belong on the VolumeAttachment or PersistentVolume itself. Today it only
+// records whether the volume went through CSI Migration translation, so telemetry and
+// logging can tell a translated in-tree volume apart from a native CSI one.
+type AdditionalInfo struct {
+	// Migrated is "true" when the PersistentVolume was translated from an in-tree
+	// volume source to its CSI equivalent before this RPC was issued.
+	Migrated string
+}
+
+// MarkContextAsMigrated returns a copy of ctx annotated to indicate that the volume
+// being processed through it was translated from an in-tree volume source via CSI
+// Migration.
+func MarkContextAsMigrated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, additionalInfoKey{}, AdditionalInfo{Migrated: "true"})
+}
+
+// AdditionalInfoFromContext extracts the AdditionalInfo previously attached with
+// MarkContextAsMigrated. The second return value is false if ctx was never marked.
+func AdditionalInfoFromContext(ctx context.Context) (AdditionalInfo, bool) {
+	info, ok := ctx.Value(additionalInfoKey{}).(AdditionalInfo)
+	return info, ok
+}
+
+// translator is the subset of csi-translation-lib's CSITranslator this package relies
+// on. It exists so tests can plug in a fake instead of depending on the real in-tree
+// plugin translation logic for every provider.
+type translator interface {
+	GetInTreePluginNameFromSpec(pv *v1.PersistentVolume, vol *v1.Volume) (string, error)
+	TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.PersistentVolume, error)
+}
+
+// newTranslator returns the real csi-translation-lib translator. Tests override this
+// var to substitute a fake.
+var newTranslator = func() translator { return csitrans.New() }
+
+// MigrationConfig controls whether, and for which in-tree plugins, CSI Migration
+// translation is performed before Attach/Detach RPCs are issued. It is built with
+// NewMigrationConfig from an enabled switch and a list of in-tree plugin names;
+// pkg/controller reads no command-line flags and defines none for these settings.
+//
+// There is deliberately no translation back the other way: VolumeAttachment.Status
+// (Attached, AttachmentMetadata, AttachError/DetachError) is already driver-agnostic --
+// a bool and opaque string maps -- so the in-tree AttachDetachController that reads it
+// needs nothing CSI-shaped rewritten into in-tree form.
+type MigrationConfig struct {
+	enabled bool
+	plugins map[string]bool
+}
+
+// NewMigrationConfig builds a MigrationConfig. pluginNamesCSV is a comma separated list
+// of in-tree plugin names CSI Migration is enabled for, e.g.
+// "kubernetes.io/gce-pd,kubernetes.io/aws-ebs"; it is only consulted when enabled is true.
+func NewMigrationConfig(enabled bool, pluginNamesCSV string) MigrationConfig {
+	plugins := map[string]bool{}
+	for _, name := range strings.Split(pluginNamesCSV, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			plugins[name] = true
+		}
+	}
+	return MigrationConfig{enabled: enabled, plugins: plugins}
+}
+
+// IsPVMigratable reports whether pvSpec references an in-tree volume plugin (GCE PD, AWS
+// EBS, Azure Disk, Cinder, ...) that CSI Migration is enabled for and knows how to
+// translate. CSI PVs are never migratable.
+func (c MigrationConfig) IsPVMigratable(pvSpec *v1.PersistentVolumeSpec) bool {
+	if !c.enabled || pvSpec.CSI != nil {
+		return false
+	}
+	pluginName, err := newTranslator().GetInTreePluginNameFromSpec(&v1.PersistentVolume{Spec: *pvSpec}, nil)
+	if err != nil {
+		return false
+	}
+	return c.plugins[pluginName]
+}
+
+// TranslateInTreePVToCSI converts an in-tree PersistentVolumeSpec into the CSI
+// PersistentVolumeSpec the driver expects, using csi-translation-lib. It returns pvSpec
+// unchanged when it already has a CSI volume source. Callers that want translation to be
+// conditional on CSI Migration being enabled for the plugin should check IsPVMigratable
+// first, as translateIfMigratable does.
+func (c MigrationConfig) TranslateInTreePVToCSI(pvSpec *v1.PersistentVolumeSpec) (*v1.PersistentVolumeSpec, error) {
+	if pvSpec.CSI != nil {
+		return pvSpec, nil
+	}
+
+	pv := &v1.PersistentVolume{Spec: *pvSpec}
+	translatedPV, err := newTranslator().TranslateInTreePVToCSI(pv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to translate in-tree PersistentVolume to its CSI equivalent: %v", err)
+	}
+	return &translatedPV.Spec, nil
+}
+
+// translateIfMigratable runs pvSpec through TranslateInTreePVToCSI when IsPVMigratable
+// says CSI Migration applies to it, and returns it unchanged otherwise.
+func (c MigrationConfig) translateIfMigratable(pvSpec *v1.PersistentVolumeSpec) (*v1.PersistentVolumeSpec, error) {
+	if !c.IsPVMigratable(pvSpec) {
+		return pvSpec, nil
+	}
+	return c.TranslateInTreePVToCSI(pvSpec)
+}
+
+// GetVolumeCapabilities translates pvSpec first when CSI Migration applies to it, then
+// delegates to the package-level GetVolumeCapabilities, so in-tree and native CSI
+// PersistentVolumes go through identical access-mode handling. The returned context is
+// marked with MarkContextAsMigrated when translation happened, so the RPC call site can
+// annotate telemetry for a translated in-tree volume; ctx is returned unchanged when
+// pvSpec was already a native CSI volume.
+func (c MigrationConfig) GetVolumeCapabilities(ctx context.Context, pvSpec *v1.PersistentVolumeSpec, driverAccessModes []csi.VolumeCapability_AccessMode_Mode) (context.Context, *csi.VolumeCapability, error) {
+	migrated := c.IsPVMigratable(pvSpec)
+	translatedSpec, err := c.translateIfMigratable(pvSpec)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if migrated {
+		ctx = MarkContextAsMigrated(ctx)
+	}
+	volumeCapability, err := GetVolumeCapabilities(translatedSpec, driverAccessModes)
+	return ctx, volumeCapability, err
+}
+
+// GetVolumeHandle translates pvSpec first when CSI Migration applies to it, then
+// delegates to the package-level GetVolumeHandle. Like GetVolumeCapabilities, the
+// returned context is marked with MarkContextAsMigrated when translation happened.
+func (c MigrationConfig) GetVolumeHandle(ctx context.Context, pvSpec *v1.PersistentVolumeSpec) (context.Context, string, bool, error) {
+	migrated := c.IsPVMigratable(pvSpec)
+	translatedSpec, err := c.translateIfMigratable(pvSpec)
+	if err != nil {
+		return ctx, "", false, err
+	}
+	if migrated {
+		ctx = MarkContextAsMigrated(ctx)
+	}
+	handle, readOnly, err := GetVolumeHandle(translatedSpec.CSI)
+	return ctx, handle, readOnly, err
+}
+
+// GetVolumeAttributes translates pvSpec first when CSI Migration applies to it, then
+// delegates to the package-level GetVolumeAttributes. Like GetVolumeCapabilities, the
+// returned context is marked with MarkContextAsMigrated when translation happened.
+func (c MigrationConfig) GetVolumeAttributes(ctx context.Context, pvSpec *v1.PersistentVolumeSpec) (context.Context, map[string]string, error) {
+	migrated := c.IsPVMigratable(pvSpec)
+	translatedSpec, err := c.translateIfMigratable(pvSpec)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if migrated {
+		ctx = MarkContextAsMigrated(ctx)
+	}
+	attributes, err := GetVolumeAttributes(translatedSpec.CSI)
+	return ctx, attributes, err
+}
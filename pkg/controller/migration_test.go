@@ -0,0 +1,245 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestMarkContextAsMigrated(t *testing.T) {
+	ctx := MarkContextAsMigrated(context.Background())
+	info, ok := AdditionalInfoFromContext(ctx)
+	if !ok {
+		t.Fatalf("expected AdditionalInfo to be present in context")
+	}
+	if info.Migrated != "true" {
+		t.Errorf("expected Migrated to be \"true\", got %q", info.Migrated)
+	}
+
+	if _, ok := AdditionalInfoFromContext(context.Background()); ok {
+		t.Errorf("expected no AdditionalInfo in an unmarked context")
+	}
+}
+
+// fakeTranslator is a minimal stand-in for csi-translation-lib's CSITranslator that
+// recognizes a single in-tree plugin, so tests don't depend on the real per-provider
+// translation logic.
+type fakeTranslator struct {
+	pluginName   string
+	translatedPV *v1.PersistentVolume
+}
+
+func (f fakeTranslator) GetInTreePluginNameFromSpec(pv *v1.PersistentVolume, vol *v1.Volume) (string, error) {
+	if pv.Spec.GCEPersistentDisk == nil {
+		return "", fmt.Errorf("no in-tree plugin recognizes this PersistentVolumeSpec")
+	}
+	return f.pluginName, nil
+}
+
+func (f fakeTranslator) TranslateInTreePVToCSI(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	translated := f.translatedPV.DeepCopy()
+	if pv.Spec.GCEPersistentDisk != nil {
+		translated.Spec.CSI.VolumeHandle = fmt.Sprintf("projects/my-project/zones/us-central1-a/disks/%s", pv.Spec.GCEPersistentDisk.PDName)
+	}
+	return translated, nil
+}
+
+func withFakeTranslator(t *testing.T, f translator) {
+	t.Helper()
+	original := newTranslator
+	newTranslator = func() translator { return f }
+	t.Cleanup(func() { newTranslator = original })
+}
+
+const gcePDPluginName = "kubernetes.io/gce-pd"
+
+func gceInTreePVSpec() *v1.PersistentVolumeSpec {
+	return &v1.PersistentVolumeSpec{
+		AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		PersistentVolumeSource: v1.PersistentVolumeSource{
+			GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "my-disk"},
+		},
+	}
+}
+
+func translatedCSIPV() *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       "pd.csi.storage.gke.io",
+					VolumeHandle: "projects/my-project/zones/us-central1-a/disks/my-disk",
+				},
+			},
+		},
+	}
+}
+
+func TestIsPVMigratable(t *testing.T) {
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName})
+
+	tests := []struct {
+		name     string
+		config   MigrationConfig
+		pvSpec   *v1.PersistentVolumeSpec
+		expected bool
+	}{
+		{
+			name:     "disabled",
+			config:   NewMigrationConfig(false, gcePDPluginName),
+			pvSpec:   gceInTreePVSpec(),
+			expected: false,
+		},
+		{
+			name:     "enabled but plugin not listed",
+			config:   NewMigrationConfig(true, "kubernetes.io/aws-ebs"),
+			pvSpec:   gceInTreePVSpec(),
+			expected: false,
+		},
+		{
+			name:     "enabled and plugin listed",
+			config:   NewMigrationConfig(true, gcePDPluginName),
+			pvSpec:   gceInTreePVSpec(),
+			expected: true,
+		},
+		{
+			name:   "already a CSI volume",
+			config: NewMigrationConfig(true, gcePDPluginName),
+			pvSpec: &v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: "csi.example.com"},
+				},
+			},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.config.IsPVMigratable(test.pvSpec); got != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestTranslateInTreePVToCSIPassesThroughCSIVolumes(t *testing.T) {
+	config := NewMigrationConfig(true, gcePDPluginName)
+	pvSpec := &v1.PersistentVolumeSpec{
+		PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{
+				Driver:       "csi.example.com",
+				VolumeHandle: "vol-1",
+			},
+		},
+	}
+
+	translated, err := config.TranslateInTreePVToCSI(pvSpec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if translated != pvSpec {
+		t.Errorf("expected CSI volume to be returned unchanged")
+	}
+}
+
+func TestMigrationConfigGetVolumeCapabilitiesTranslatesInTreeVolume(t *testing.T) {
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName, translatedPV: translatedCSIPV()})
+	config := NewMigrationConfig(true, gcePDPluginName)
+
+	ctx, cap, err := config.GetVolumeCapabilities(context.Background(), gceInTreePVSpec(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cap.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		t.Errorf("expected SINGLE_NODE_WRITER, got %s", cap.AccessMode.Mode)
+	}
+	if cap.GetMount().GetFsType() != defaultFSType {
+		t.Errorf("expected translated volume to still go through the normal FSType defaulting, got %q", cap.GetMount().GetFsType())
+	}
+	if info, ok := AdditionalInfoFromContext(ctx); !ok || info.Migrated != "true" {
+		t.Errorf("expected the returned context to be marked as migrated")
+	}
+}
+
+func TestMigrationConfigGetVolumeHandleTranslatesInTreeVolume(t *testing.T) {
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName, translatedPV: translatedCSIPV()})
+	config := NewMigrationConfig(true, gcePDPluginName)
+
+	ctx, handle, readOnly, err := config.GetVolumeHandle(context.Background(), gceInTreePVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := "projects/my-project/zones/us-central1-a/disks/my-disk"
+	if handle != want {
+		t.Errorf("expected translated VolumeHandle %q, got %q", want, handle)
+	}
+	if readOnly {
+		t.Errorf("expected ReadOnly to be false")
+	}
+	if info, ok := AdditionalInfoFromContext(ctx); !ok || info.Migrated != "true" {
+		t.Errorf("expected the returned context to be marked as migrated")
+	}
+}
+
+func TestMigrationConfigGetVolumeAttributesTranslatesInTreeVolume(t *testing.T) {
+	translatedPV := translatedCSIPV()
+	translatedPV.Spec.CSI.VolumeAttributes = map[string]string{"foo": "bar"}
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName, translatedPV: translatedPV})
+	config := NewMigrationConfig(true, gcePDPluginName)
+
+	ctx, attributes, err := config.GetVolumeAttributes(context.Background(), gceInTreePVSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if attributes["foo"] != "bar" {
+		t.Errorf("expected translated VolumeAttributes, got %+v", attributes)
+	}
+	if info, ok := AdditionalInfoFromContext(ctx); !ok || info.Migrated != "true" {
+		t.Errorf("expected the returned context to be marked as migrated")
+	}
+}
+
+func TestMigrationConfigGetVolumeHandleLeavesCSIVolumeAlone(t *testing.T) {
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName})
+	config := NewMigrationConfig(true, gcePDPluginName)
+
+	pvSpec := &v1.PersistentVolumeSpec{
+		PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{
+				Driver:       "csi.example.com",
+				VolumeHandle: "vol-1",
+			},
+		},
+	}
+	ctx, handle, _, err := config.GetVolumeHandle(context.Background(), pvSpec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if handle != "vol-1" {
+		t.Errorf("expected untranslated handle %q, got %q", "vol-1", handle)
+	}
+	if _, ok := AdditionalInfoFromContext(ctx); ok {
+		t.Errorf("expected the returned context to be left unmarked for an already-CSI volume")
+	}
+}
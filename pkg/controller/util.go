@@ -21,15 +21,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	jsonpatch "github.com/evanphx/json-patch"
 	v1 "k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
@@ -106,6 +114,83 @@ func markAsDetached(client kubernetes.Interface, va *storage.VolumeAttachment) (
 	return newVA, nil
 }
 
+// ImmutableFieldsError is returned by UpdateVolumeAttachment when new changes a
+// VolumeAttachment field that must stay constant for the life of the attachment.
+type ImmutableFieldsError struct {
+	Fields []string
+}
+
+func (e *ImmutableFieldsError) Error() string {
+	return fmt.Sprintf("VolumeAttachment update changes immutable field(s): %s", strings.Join(e.Fields, ", "))
+}
+
+// UpdateVolumeAttachment returns a merge patch from old to new, or an *ImmutableFieldsError
+// if new changes a field that must stay constant for the life of the attachment. oldPVSpec
+// and newPVSpec are the spec of the PersistentVolume named by Spec.Source.PersistentVolumeName,
+// before and after; pass nil for both when the attachment uses Spec.Source.InlineVolumeSpec instead.
+func UpdateVolumeAttachment(old, new *storage.VolumeAttachment, oldPVSpec, newPVSpec *v1.PersistentVolumeSpec, migration MigrationConfig) ([]byte, error) {
+	var violations []string
+	if old.Spec.Attacher != new.Spec.Attacher {
+		violations = append(violations, "spec.attacher")
+	}
+	if old.Spec.NodeName != new.Spec.NodeName {
+		violations = append(violations, "spec.nodeName")
+	}
+	if !reflect.DeepEqual(old.Spec.Source.PersistentVolumeName, new.Spec.Source.PersistentVolumeName) {
+		violations = append(violations, "spec.source.persistentVolumeName")
+	}
+	violations = append(violations, diffImmutablePVFields("spec.source.inlineVolumeSpec", old.Spec.Source.InlineVolumeSpec, new.Spec.Source.InlineVolumeSpec, migration)...)
+	violations = append(violations, diffImmutablePVFields("persistentVolume.spec", oldPVSpec, newPVSpec, migration)...)
+
+	if len(violations) > 0 {
+		return nil, &ImmutableFieldsError{Fields: violations}
+	}
+
+	return createMergePatch(old, new)
+}
+
+// diffImmutablePVFields reports which CSI-immutable fields (AccessModes, VolumeMode, CSI
+// driver name, VolumeHandle, FSType, ReadOnly) differ between old and new, prefixing each
+// with prefix. old and new are translated through migration first, so an in-tree identity
+// change (e.g. GCEPersistentDisk.PDName) isn't hidden behind their always-nil CSI field.
+func diffImmutablePVFields(prefix string, old, new *v1.PersistentVolumeSpec, migration MigrationConfig) []string {
+	if old == nil && new == nil {
+		return nil
+	}
+	if old == nil || new == nil {
+		return []string{prefix}
+	}
+
+	old = translatedOrOriginal(migration, old)
+	new = translatedOrOriginal(migration, new)
+
+	var violations []string
+	if !reflect.DeepEqual(old.AccessModes, new.AccessModes) {
+		violations = append(violations, prefix+".accessModes")
+	}
+	if !reflect.DeepEqual(old.VolumeMode, new.VolumeMode) {
+		violations = append(violations, prefix+".volumeMode")
+	}
+	switch {
+	case old.CSI == nil && new.CSI == nil:
+	case old.CSI == nil || new.CSI == nil:
+		violations = append(violations, prefix+".csi")
+	case old.CSI.Driver != new.CSI.Driver || old.CSI.VolumeHandle != new.CSI.VolumeHandle ||
+		old.CSI.ReadOnly != new.CSI.ReadOnly || old.CSI.FSType != new.CSI.FSType:
+		violations = append(violations, prefix+".csi")
+	}
+	return violations
+}
+
+// translatedOrOriginal returns pvSpec translated to CSI via migration, or pvSpec itself if that fails
+func translatedOrOriginal(migration MigrationConfig, pvSpec *v1.PersistentVolumeSpec) *v1.PersistentVolumeSpec {
+	translated, err := migration.translateIfMigratable(pvSpec)
+	if err != nil {
+		return pvSpec
+	}
+	return translated
+}
+
 const (
 	defaultFSType              = "ext4"
 	csiVolAttribsAnnotationKey = "csi.volume.kubernetes.io/volume-attributes"
@@ -138,8 +223,76 @@ func GetNodeIDFromCSINode(driver string, csiNode *storage.CSINode) (string, bool
 	return "", false
 }
 
-// GetVolumeCapabilities returns volumecapability from PV spec
-func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapability, error) {
+// IsAttachRequired looks up the CSIDriver object registered for driver and reports
+// whether the external-attacher must issue ControllerPublishVolume/ControllerUnpublishVolume
+// for it. A driver with no CSIDriver object, or one that doesn't set Spec.AttachRequired,
+// defaults to true so unregistered and legacy drivers keep going through the normal
+// attach/detach path.
+func IsAttachRequired(driver string, csiDriverLister storagelisters.CSIDriverLister) (bool, error) {
+	csiDriver, err := csiDriverLister.Get(driver)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if csiDriver.Spec.AttachRequired != nil && !*csiDriver.Spec.AttachRequired {
+		return false, nil
+	}
+	return true, nil
+}
+
+// SkipAttachIfNotRequired marks va attached without calling ControllerPublishVolume when
+// the driver has opted out of attach via CSIDriver.Spec.AttachRequired=false
+func SkipAttachIfNotRequired(client kubernetes.Interface, va *storage.VolumeAttachment, csiDriverLister storagelisters.CSIDriverLister) (out *storage.VolumeAttachment, handled bool, err error) {
+	attachRequired, err := IsAttachRequired(va.Spec.Attacher, csiDriverLister)
+	if err != nil || attachRequired {
+		return va, false, err
+	}
+	out, err = markAsAttached(client, va, map[string]string{})
+	return out, true, err
+}
+
+// SkipDetachIfNotRequired marks va detached without calling ControllerUnpublishVolume when
+// the driver has opted out of attach via CSIDriver.Spec.AttachRequired=false
+func SkipDetachIfNotRequired(client kubernetes.Interface, va *storage.VolumeAttachment, csiDriverLister storagelisters.CSIDriverLister) (out *storage.VolumeAttachment, handled bool, err error) {
+	attachRequired, err := IsAttachRequired(va.Spec.Attacher, csiDriverLister)
+	if err != nil || attachRequired {
+		return va, false, err
+	}
+	out, err = markAsDetached(client, va)
+	return out, true, err
+}
+
+// accessModePreferences lists, for each PersistentVolume access mode, the CSI access
+// modes that satisfy it, ordered from most restrictive to least restrictive. The last
+// entry is the legacy 1:1 mapping used when the driver's supported access modes are
+// unknown, so existing drivers keep working exactly as before.
+var accessModePreferences = map[v1.PersistentVolumeAccessMode][]csi.VolumeCapability_AccessMode_Mode{
+	v1.ReadWriteOncePod: {
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	},
+	v1.ReadWriteOnce: {
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	},
+	v1.ReadOnlyMany: {
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	},
+	v1.ReadWriteMany: {
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	},
+}
+
+// GetVolumeCapabilities returns volumecapability from PV spec. driverAccessModes is the
+// list of CSI access modes the driver advertises via ControllerGetCapabilities /
+// GetPluginCapabilities; for each PV access mode, the most restrictive CSI access mode
+// the driver supports is picked. When driverAccessModes is empty (driver capabilities not
+// known), GetVolumeCapabilities falls back to the legacy 1:1 mapping.
+func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec, driverAccessModes []csi.VolumeCapability_AccessMode_Mode) (*csi.VolumeCapability, error) {
 	m := map[v1.PersistentVolumeAccessMode]bool{}
 	for _, mode := range pvSpec.AccessModes {
 		m[mode] = true
@@ -175,28 +328,77 @@ func GetVolumeCapabilities(pvSpec *v1.PersistentVolumeSpec) (*csi.VolumeCapabili
 		}
 	}
 
-	// Translate array of modes into single VolumeCapability
+	pvAccessMode, err := choosePVAccessMode(m)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := chooseCSIAccessMode(pvAccessMode, driverAccessModes)
+	if err != nil {
+		return nil, err
+	}
+	cap.AccessMode.Mode = mode
+	return cap, nil
+}
+
+// choosePVAccessMode picks the single PersistentVolume access mode that governs the
+// VolumeCapability, enforcing the same precedence and invalid-combination rules the
+// mapping has always had: ReadWriteOncePod is exclusive and wins when present alone,
+// ReadWriteMany trumps everything else, and ReadOnlyMany+ReadWriteOnce together are
+// rejected outright.
+func choosePVAccessMode(m map[v1.PersistentVolumeAccessMode]bool) (v1.PersistentVolumeAccessMode, error) {
 	switch {
+	case m[v1.ReadWriteOncePod]:
+		// ReadWriteOncePod is exclusive: per the KEP it must not be combined with
+		// any other access mode on the same PersistentVolume.
+		if len(m) > 1 {
+			return "", fmt.Errorf("CSI does not support ReadWriteOncePod combined with any other access mode")
+		}
+		return v1.ReadWriteOncePod, nil
+
 	case m[v1.ReadWriteMany]:
 		// ReadWriteMany trumps everything, regardless what other modes are set
-		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+		return v1.ReadWriteMany, nil
 
 	case m[v1.ReadOnlyMany] && m[v1.ReadWriteOnce]:
 		// This is no way how to translate this to CSI...
-		return nil, fmt.Errorf("CSI does not support ReadOnlyMany and ReadWriteOnce on the same PersistentVolume")
+		return "", fmt.Errorf("CSI does not support ReadOnlyMany and ReadWriteOnce on the same PersistentVolume")
 
 	case m[v1.ReadOnlyMany]:
 		// There is only ReadOnlyMany set
-		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+		return v1.ReadOnlyMany, nil
 
 	case m[v1.ReadWriteOnce]:
 		// There is only ReadWriteOnce set
-		cap.AccessMode.Mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		return v1.ReadWriteOnce, nil
 
 	default:
-		return nil, fmt.Errorf("unsupported AccessMode combination: %+v", pvSpec.AccessModes)
+		return "", fmt.Errorf("unsupported AccessMode combination: %+v", m)
 	}
-	return cap, nil
+}
+
+// chooseCSIAccessMode maps pvAccessMode to the most restrictive CSI access mode listed
+// in accessModePreferences that the driver supports. It falls back to the legacy mapping
+// only when driverAccessModes is empty, i.e. the driver's capabilities are unknown; when
+// driverAccessModes is non-empty but doesn't contain any mode preferred for pvAccessMode,
+// including the legacy one, it returns an error instead of guessing a mode the driver
+// never advertised.
+func chooseCSIAccessMode(pvAccessMode v1.PersistentVolumeAccessMode, driverAccessModes []csi.VolumeCapability_AccessMode_Mode) (csi.VolumeCapability_AccessMode_Mode, error) {
+	preferences := accessModePreferences[pvAccessMode]
+	legacyMode := preferences[len(preferences)-1]
+	if len(driverAccessModes) == 0 {
+		return legacyMode, nil
+	}
+
+	supported := make(map[csi.VolumeCapability_AccessMode_Mode]bool, len(driverAccessModes))
+	for _, mode := range driverAccessModes {
+		supported[mode] = true
+	}
+	for _, mode := range preferences {
+		if supported[mode] {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("driver does not support any CSI access mode for PersistentVolume access mode %q", pvAccessMode)
 }
 
 // GetVolumeHandle returns VolumeHandle and Readonly flag from CSI PV source
@@ -215,9 +417,99 @@ func GetVolumeAttributes(csiSource *v1.CSIPersistentVolumeSource) (map[string]st
 	return csiSource.VolumeAttributes, nil
 }
 
-// MarkContextAsMigrated creates and returns a context with the migrated label
-func MarkContextAsMigrated(ctx context.Context) {
-	return context.WithValue(ctx, AdditionalInfo, AdditionalInfo{Migrated: "migrated"})
+// Keys of the standard pod info entries CSI drivers with PodInfoOnMount=true expect
+// to find in the ControllerPublishVolume volume context, as defined by the CSI spec.
+const (
+	podNameKey            = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey       = "csi.storage.k8s.io/pod.namespace"
+	podUIDKey             = "csi.storage.k8s.io/pod.uid"
+	serviceAccountNameKey = "csi.storage.k8s.io/serviceAccount.name"
+	ephemeralKey          = "csi.storage.k8s.io/ephemeral"
+)
+
+// GetVolumeContextWithPodInfo returns attributes augmented with the standard pod info
+// entries (pod.name, pod.namespace, pod.uid, serviceAccount.name, ephemeral) for pod,
+// as required by drivers with CSIDriver.Spec.PodInfoOnMount set to true. attributes is
+// returned unchanged when podInfoEnabled is false, matching drivers that don't request
+// pod info at all.
+func GetVolumeContextWithPodInfo(attributes map[string]string, pod *v1.Pod, podInfoEnabled, ephemeral bool) map[string]string {
+	if !podInfoEnabled || pod == nil {
+		return attributes
+	}
+
+	result := make(map[string]string, len(attributes)+5)
+	for k, v := range attributes {
+		result[k] = v
+	}
+	result[podNameKey] = pod.Name
+	result[podNamespaceKey] = pod.Namespace
+	result[podUIDKey] = string(pod.UID)
+	result[serviceAccountNameKey] = pod.Spec.ServiceAccountName
+	result[ephemeralKey] = strconv.FormatBool(ephemeral)
+	return result
+}
+
+// vaPodRefAnnotationKey records "<namespace>/<name>" of the Pod that triggered a VolumeAttachment
+const vaPodRefAnnotationKey = "csi.alpha.kubernetes.io/pod-ref"
+
+// FindReferencedPod returns the Pod that triggered va, or nil if none can be resolved
+func FindReferencedPod(va *storage.VolumeAttachment, pvLister corelisters.PersistentVolumeLister, podLister corelisters.PodLister) (*v1.Pod, error) {
+	if ref, ok := va.Annotations[vaPodRefAnnotationKey]; ok {
+		namespace, name, err := cache.SplitMetaNamespaceKey(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation %q: %v", vaPodRefAnnotationKey, ref, err)
+		}
+		pod, err := podLister.Pods(namespace).Get(name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return pod, nil
+	}
+
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return nil, nil
+	}
+	pv, err := pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if pv.Spec.ClaimRef == nil {
+		return nil, nil
+	}
+
+	pods, err := podLister.Pods(pv.Spec.ClaimRef.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName != va.Spec.NodeName {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pv.Spec.ClaimRef.Name {
+				return pod, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// GetVolumeContextForVolumeAttachment merges the Pod that triggered va into attributes via FindReferencedPod
+func GetVolumeContextForVolumeAttachment(attributes map[string]string, va *storage.VolumeAttachment, podInfoEnabled, ephemeral bool, pvLister corelisters.PersistentVolumeLister, podLister corelisters.PodLister) (map[string]string, error) {
+	if !podInfoEnabled {
+		return attributes, nil
+	}
+	pod, err := FindReferencedPod(va, pvLister, podLister)
+	if err != nil {
+		return nil, err
+	}
+	return GetVolumeContextWithPodInfo(attributes, pod, podInfoEnabled, ephemeral), nil
 }
 
 // createMergePatch return patch generated from original and new interfaces
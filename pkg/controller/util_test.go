@@ -0,0 +1,704 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+)
+
+func newPVLister(pvs ...*v1.PersistentVolume) corelisters.PersistentVolumeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pv := range pvs {
+		indexer.Add(pv)
+	}
+	return corelisters.NewPersistentVolumeLister(indexer)
+}
+
+func newPodLister(pods ...*v1.Pod) corelisters.PodLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pod := range pods {
+		indexer.Add(pod)
+	}
+	return corelisters.NewPodLister(indexer)
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func newCSIDriverLister(drivers ...*storage.CSIDriver) storagelisters.CSIDriverLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, driver := range drivers {
+		indexer.Add(driver)
+	}
+	return storagelisters.NewCSIDriverLister(indexer)
+}
+
+func TestGetVolumeCapabilities(t *testing.T) {
+	tests := []struct {
+		name              string
+		accessModes       []v1.PersistentVolumeAccessMode
+		driverAccessModes []csi.VolumeCapability_AccessMode_Mode
+		expectMode        csi.VolumeCapability_AccessMode_Mode
+		expectError       bool
+	}{
+		{
+			name:        "ReadWriteOnce, driver capabilities unknown",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			expectMode:  csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+		{
+			name:        "ReadOnlyMany",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany},
+			expectMode:  csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+		{
+			name:        "ReadWriteMany, driver capabilities unknown",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			expectMode:  csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+		{
+			name:        "ReadWriteOncePod",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOncePod},
+			expectMode:  csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		},
+		{
+			name:        "ReadOnlyMany and ReadWriteOnce is invalid",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadOnlyMany, v1.ReadWriteOnce},
+			expectError: true,
+		},
+		{
+			name:        "ReadWriteOncePod combined with ReadWriteOnce is invalid",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOncePod, v1.ReadWriteOnce},
+			expectError: true,
+		},
+		{
+			name:        "ReadWriteOncePod combined with ReadWriteMany is invalid",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOncePod, v1.ReadWriteMany},
+			expectError: true,
+		},
+		{
+			name:        "ReadWriteOnce, driver only supports SINGLE_NODE_MULTI_WRITER",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			driverAccessModes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			},
+			expectMode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		},
+		{
+			name:        "ReadWriteMany, driver only supports MULTI_NODE_SINGLE_WRITER",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			driverAccessModes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+			},
+			expectMode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		},
+		{
+			name:        "ReadWriteOnce, driver advertises no compatible mode is an error",
+			accessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			driverAccessModes: []csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvSpec := &v1.PersistentVolumeSpec{
+				AccessModes: test.accessModes,
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{},
+				},
+			}
+			cap, err := GetVolumeCapabilities(pvSpec, test.driverAccessModes)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if cap.AccessMode.Mode != test.expectMode {
+				t.Errorf("expected mode %s, got %s", test.expectMode, cap.AccessMode.Mode)
+			}
+		})
+	}
+}
+
+func TestIsAttachRequired(t *testing.T) {
+	tests := []struct {
+		name         string
+		driverName   string
+		csiDrivers   []*storage.CSIDriver
+		expectResult bool
+		expectError  bool
+	}{
+		{
+			name:         "no CSIDriver object defaults to attach required",
+			driverName:   "unregistered.example.com",
+			expectResult: true,
+		},
+		{
+			name:       "CSIDriver without AttachRequired defaults to attach required",
+			driverName: "no-attach-required.example.com",
+			csiDrivers: []*storage.CSIDriver{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "no-attach-required.example.com"},
+				},
+			},
+			expectResult: true,
+		},
+		{
+			name:       "CSIDriver with AttachRequired=true",
+			driverName: "attach-required.example.com",
+			csiDrivers: []*storage.CSIDriver{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "attach-required.example.com"},
+					Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(true)},
+				},
+			},
+			expectResult: true,
+		},
+		{
+			name:       "CSIDriver with AttachRequired=false",
+			driverName: "no-attach.example.com",
+			csiDrivers: []*storage.CSIDriver{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "no-attach.example.com"},
+					Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+				},
+			},
+			expectResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lister := newCSIDriverLister(test.csiDrivers...)
+			result, err := IsAttachRequired(test.driverName, lister)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if result != test.expectResult {
+				t.Errorf("expected %v, got %v", test.expectResult, result)
+			}
+		})
+	}
+}
+
+func TestSkipAttachIfNotRequired(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1", Finalizers: []string{GetFinalizerName("no-attach.example.com")}},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "no-attach.example.com", NodeName: "node-1"},
+	}
+	lister := newCSIDriverLister(&storage.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-attach.example.com"},
+		Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+	})
+	client := fake.NewSimpleClientset(va)
+
+	out, handled, err := SkipAttachIfNotRequired(client, va, lister)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !handled {
+		t.Fatalf("expected handled=true for an AttachRequired=false driver")
+	}
+	if !out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked attached")
+	}
+
+	attachRequiredVA := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-2"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "attach-required.example.com", NodeName: "node-1"},
+	}
+	out, handled, err = SkipAttachIfNotRequired(fake.NewSimpleClientset(attachRequiredVA), attachRequiredVA, lister)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if handled {
+		t.Fatalf("expected handled=false when no CSIDriver opts out of attach")
+	}
+	if out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be left untouched")
+	}
+}
+
+func TestSkipDetachIfNotRequired(t *testing.T) {
+	finalizer := GetFinalizerName("no-attach.example.com")
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1", Finalizers: []string{finalizer}},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "no-attach.example.com", NodeName: "node-1"},
+		Status:     storage.VolumeAttachmentStatus{Attached: true},
+	}
+	lister := newCSIDriverLister(&storage.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-attach.example.com"},
+		Spec:       storage.CSIDriverSpec{AttachRequired: boolPtr(false)},
+	})
+	client := fake.NewSimpleClientset(va)
+
+	out, handled, err := SkipDetachIfNotRequired(client, va, lister)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !handled {
+		t.Fatalf("expected handled=true for an AttachRequired=false driver")
+	}
+	if out.Status.Attached {
+		t.Errorf("expected the VolumeAttachment to be marked detached")
+	}
+	for _, f := range out.Finalizers {
+		if f == finalizer {
+			t.Errorf("expected the finalizer to be removed")
+		}
+	}
+
+	attachRequiredVA := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-2"},
+		Spec:       storage.VolumeAttachmentSpec{Attacher: "attach-required.example.com", NodeName: "node-1"},
+	}
+	out, handled, err = SkipDetachIfNotRequired(fake.NewSimpleClientset(attachRequiredVA), attachRequiredVA, lister)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if handled {
+		t.Fatalf("expected handled=false when no CSIDriver opts out of attach")
+	}
+}
+
+func TestGetVolumeContextWithPodInfo(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "my-pod",
+			Namespace: "my-ns",
+			UID:       "1234-5678",
+		},
+		Spec: v1.PodSpec{
+			ServiceAccountName: "my-sa",
+		},
+	}
+
+	tests := []struct {
+		name           string
+		attributes     map[string]string
+		pod            *v1.Pod
+		podInfoEnabled bool
+		ephemeral      bool
+		expected       map[string]string
+	}{
+		{
+			name:           "PodInfoOnMount disabled leaves attributes untouched",
+			attributes:     map[string]string{"foo": "bar"},
+			pod:            pod,
+			podInfoEnabled: false,
+			expected:       map[string]string{"foo": "bar"},
+		},
+		{
+			name:           "PodInfoOnMount enabled adds pod info",
+			attributes:     map[string]string{"foo": "bar"},
+			pod:            pod,
+			podInfoEnabled: true,
+			ephemeral:      true,
+			expected: map[string]string{
+				"foo":                                    "bar",
+				"csi.storage.k8s.io/pod.name":            "my-pod",
+				"csi.storage.k8s.io/pod.namespace":       "my-ns",
+				"csi.storage.k8s.io/pod.uid":             "1234-5678",
+				"csi.storage.k8s.io/serviceAccount.name": "my-sa",
+				"csi.storage.k8s.io/ephemeral":           "true",
+			},
+		},
+		{
+			name:           "PodInfoOnMount enabled but no pod leaves attributes untouched",
+			attributes:     map[string]string{"foo": "bar"},
+			pod:            nil,
+			podInfoEnabled: true,
+			expected:       map[string]string{"foo": "bar"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := GetVolumeContextWithPodInfo(test.attributes, test.pod, test.podInfoEnabled, test.ephemeral)
+			if len(result) != len(test.expected) {
+				t.Fatalf("expected %d entries, got %d: %+v", len(test.expected), len(result), result)
+			}
+			for k, v := range test.expected {
+				if result[k] != v {
+					t.Errorf("expected %s=%q, got %q", k, v, result[k])
+				}
+			}
+		})
+	}
+}
+
+func TestFindReferencedPod(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: "my-ns", Name: "my-pvc"},
+		},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "my-ns"},
+		Spec: v1.PodSpec{
+			NodeName: "node-1",
+			Volumes: []v1.Volume{
+				{VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "my-pvc"}}},
+			},
+		},
+	}
+
+	t.Run("resolved via PVC -> Pod chain", func(t *testing.T) {
+		va := &storage.VolumeAttachment{
+			Spec: storage.VolumeAttachmentSpec{
+				NodeName: "node-1",
+				Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+			},
+		}
+		got, err := FindReferencedPod(va, newPVLister(pv), newPodLister(pod))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got == nil || got.Name != "my-pod" {
+			t.Fatalf("expected to find my-pod, got %+v", got)
+		}
+	})
+
+	t.Run("resolved via annotation", func(t *testing.T) {
+		va := &storage.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{vaPodRefAnnotationKey: "my-ns/my-pod"}},
+		}
+		got, err := FindReferencedPod(va, newPVLister(), newPodLister(pod))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got == nil || got.Name != "my-pod" {
+			t.Fatalf("expected to find my-pod, got %+v", got)
+		}
+	})
+
+	t.Run("no matching pod", func(t *testing.T) {
+		va := &storage.VolumeAttachment{
+			Spec: storage.VolumeAttachmentSpec{
+				NodeName: "node-2",
+				Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+			},
+		}
+		got, err := FindReferencedPod(va, newPVLister(pv), newPodLister(pod))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != nil {
+			t.Errorf("expected no pod, got %+v", got)
+		}
+	})
+
+	t.Run("inline volume spec has no pod to resolve", func(t *testing.T) {
+		va := &storage.VolumeAttachment{
+			Spec: storage.VolumeAttachmentSpec{
+				NodeName: "node-1",
+				Source:   storage.VolumeAttachmentSource{InlineVolumeSpec: &v1.PersistentVolumeSpec{}},
+			},
+		}
+		got, err := FindReferencedPod(va, newPVLister(pv), newPodLister(pod))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != nil {
+			t.Errorf("expected no pod, got %+v", got)
+		}
+	})
+}
+
+func TestGetVolumeContextForVolumeAttachment(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: "my-ns", Name: "my-pvc"},
+		},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "my-ns", UID: "1234"},
+		Spec: v1.PodSpec{
+			NodeName:           "node-1",
+			ServiceAccountName: "my-sa",
+			Volumes: []v1.Volume{
+				{VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "my-pvc"}}},
+			},
+		},
+	}
+	va := &storage.VolumeAttachment{
+		Spec: storage.VolumeAttachmentSpec{
+			NodeName: "node-1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+		},
+	}
+
+	t.Run("PodInfoOnMount enabled resolves and merges pod identity", func(t *testing.T) {
+		result, err := GetVolumeContextForVolumeAttachment(map[string]string{"foo": "bar"}, va, true, false, newPVLister(pv), newPodLister(pod))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if result["csi.storage.k8s.io/pod.name"] != "my-pod" {
+			t.Errorf("expected pod info to be merged, got %+v", result)
+		}
+		if result["foo"] != "bar" {
+			t.Errorf("expected existing attributes to be preserved, got %+v", result)
+		}
+	})
+
+	t.Run("PodInfoOnMount disabled skips the lookup entirely", func(t *testing.T) {
+		result, err := GetVolumeContextForVolumeAttachment(map[string]string{"foo": "bar"}, va, false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(result) != 1 || result["foo"] != "bar" {
+			t.Errorf("expected attributes untouched, got %+v", result)
+		}
+	})
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestUpdateVolumeAttachment(t *testing.T) {
+	base := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: "csi.example.com",
+			NodeName: "node-1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		mutate      func(va *storage.VolumeAttachment)
+		expectError bool
+	}{
+		{
+			name:   "no changes",
+			mutate: func(va *storage.VolumeAttachment) {},
+		},
+		{
+			name: "attacher changed is rejected",
+			mutate: func(va *storage.VolumeAttachment) {
+				va.Spec.Attacher = "other.example.com"
+			},
+			expectError: true,
+		},
+		{
+			name: "node changed is rejected",
+			mutate: func(va *storage.VolumeAttachment) {
+				va.Spec.NodeName = "node-2"
+			},
+			expectError: true,
+		},
+		{
+			name: "persistentVolumeName changed is rejected",
+			mutate: func(va *storage.VolumeAttachment) {
+				va.Spec.Source.PersistentVolumeName = stringPtr("pv-2")
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldVA := base.DeepCopy()
+			newVA := base.DeepCopy()
+			test.mutate(newVA)
+
+			patch, err := UpdateVolumeAttachment(oldVA, newVA, nil, nil, MigrationConfig{})
+			if test.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				if _, ok := err.(*ImmutableFieldsError); !ok {
+					t.Errorf("expected *ImmutableFieldsError, got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if patch == nil {
+				t.Errorf("expected a patch, got nil")
+			}
+		})
+	}
+}
+
+func TestUpdateVolumeAttachmentGuardsReferencedPersistentVolume(t *testing.T) {
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: "csi.example.com",
+			NodeName: "node-1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+		},
+	}
+	oldPVSpec := &v1.PersistentVolumeSpec{
+		AccessModes:  []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+		MountOptions: []string{"noatime"},
+		PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{
+				Driver:           "csi.example.com",
+				VolumeHandle:     "vol-1",
+				VolumeAttributes: map[string]string{"foo": "bar"},
+			},
+		},
+	}
+
+	// Adding a mount flag to the referenced PV is the "re-register" scenario the
+	// request calls out explicitly: it must be allowed without a detach/reattach.
+	newPVSpec := oldPVSpec.DeepCopy()
+	newPVSpec.MountOptions = []string{"noatime", "ro"}
+	if _, err := UpdateVolumeAttachment(va, va, oldPVSpec, newPVSpec, MigrationConfig{}); err != nil {
+		t.Fatalf("expected mount flag change on the referenced PV to be allowed, got error: %s", err)
+	}
+
+	// But a VolumeHandle, access mode, or driver change on that same PV must be
+	// refused, even though the VolumeAttachment object itself didn't change at all.
+	tests := []struct {
+		name   string
+		mutate func(spec *v1.PersistentVolumeSpec)
+	}{
+		{
+			name: "VolumeHandle changed",
+			mutate: func(spec *v1.PersistentVolumeSpec) {
+				spec.CSI.VolumeHandle = "vol-2"
+			},
+		},
+		{
+			name: "AccessModes changed",
+			mutate: func(spec *v1.PersistentVolumeSpec) {
+				spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+			},
+		},
+		{
+			name: "driver changed",
+			mutate: func(spec *v1.PersistentVolumeSpec) {
+				spec.CSI.Driver = "other.example.com"
+			},
+		},
+		{
+			name: "VolumeMode changed",
+			mutate: func(spec *v1.PersistentVolumeSpec) {
+				blockMode := v1.PersistentVolumeBlock
+				spec.VolumeMode = &blockMode
+			},
+		},
+		{
+			name: "FSType changed",
+			mutate: func(spec *v1.PersistentVolumeSpec) {
+				spec.CSI.FSType = "xfs"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mutatedPVSpec := oldPVSpec.DeepCopy()
+			test.mutate(mutatedPVSpec)
+
+			_, err := UpdateVolumeAttachment(va, va, oldPVSpec, mutatedPVSpec, MigrationConfig{})
+			if err == nil {
+				t.Fatalf("expected error, got none")
+			}
+			if _, ok := err.(*ImmutableFieldsError); !ok {
+				t.Errorf("expected *ImmutableFieldsError, got %T", err)
+			}
+		})
+	}
+}
+
+func TestUpdateVolumeAttachmentCatchesMigratedIdentityChange(t *testing.T) {
+	withFakeTranslator(t, fakeTranslator{pluginName: gcePDPluginName, translatedPV: translatedCSIPV()})
+	migration := NewMigrationConfig(true, gcePDPluginName)
+
+	va := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: "pd.csi.storage.gke.io",
+			NodeName: "node-1",
+			Source:   storage.VolumeAttachmentSource{PersistentVolumeName: stringPtr("pv-1")},
+		},
+	}
+	oldPVSpec := gceInTreePVSpec()
+	newPVSpec := oldPVSpec.DeepCopy()
+	newPVSpec.GCEPersistentDisk.PDName = "other-disk"
+
+	if _, err := UpdateVolumeAttachment(va, va, oldPVSpec, newPVSpec, migration); err == nil {
+		t.Fatalf("expected a changed in-tree disk identity to be rejected")
+	}
+}
+
+func TestUpdateVolumeAttachmentAllowsMutableInlineVolumeFields(t *testing.T) {
+	oldVA := &storage.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storage.VolumeAttachmentSpec{
+			Attacher: "csi.example.com",
+			NodeName: "node-1",
+			Source: storage.VolumeAttachmentSource{
+				InlineVolumeSpec: &v1.PersistentVolumeSpec{
+					AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+					PersistentVolumeSource: v1.PersistentVolumeSource{
+						CSI: &v1.CSIPersistentVolumeSource{
+							Driver:           "csi.example.com",
+							VolumeHandle:     "vol-1",
+							VolumeAttributes: map[string]string{"foo": "bar"},
+						},
+					},
+				},
+			},
+		},
+	}
+	newVA := oldVA.DeepCopy()
+	newVA.Spec.Source.InlineVolumeSpec.CSI.VolumeAttributes = map[string]string{"foo": "baz"}
+	newVA.Spec.Source.InlineVolumeSpec.MountOptions = []string{"ro"}
+
+	if _, err := UpdateVolumeAttachment(oldVA, newVA, nil, nil, MigrationConfig{}); err != nil {
+		t.Fatalf("expected mutable field change to be allowed, got error: %s", err)
+	}
+
+	newVA.Spec.Source.InlineVolumeSpec.CSI.VolumeHandle = "vol-2"
+	if _, err := UpdateVolumeAttachment(oldVA, newVA, nil, nil, MigrationConfig{}); err == nil {
+		t.Errorf("expected VolumeHandle change to be rejected")
+	}
+}